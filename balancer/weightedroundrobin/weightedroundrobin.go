@@ -0,0 +1,181 @@
+/*
+ *
+ * Copyright 2022 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package weightedroundrobin defines a weighted round robin balancer.
+//
+// Unlike round_robin, which spreads RPCs evenly across the set of READY
+// addresses, weighted_round_robin distributes RPCs proportionally to a
+// per-address weight. The weight comes from the resolver.Address and is set
+// with SetAddrInfo; addresses without a weight are treated as weight 1, and
+// if no address in the update carries a weight, the picker falls back to
+// plain round robin.
+package weightedroundrobin
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+// Name is the name of the weighted_round_robin balancer.
+const Name = "weighted_round_robin"
+
+func init() {
+	balancer.Register(bb{})
+}
+
+type bb struct{}
+
+func (bb) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	return base.NewBalancerBuilder(Name, &pickerBuilder{}, base.Config{HealthCheck: true}).Build(cc, opts)
+}
+
+func (bb) Name() string {
+	return Name
+}
+
+type attributeKey struct{}
+
+// AddrInfo is the weighted_round_robin-specific attribute attached to a
+// resolver.Address via SetAddrInfo and retrieved via GetAddrInfo. Weight is
+// relative to the weights of other addresses in the same resolver update; it
+// carries no meaning on its own.
+type AddrInfo struct {
+	Weight uint32
+}
+
+// Equal allows the values to be compared by Attributes.Equal.
+func (a AddrInfo) Equal(o any) bool {
+	oa, ok := o.(AddrInfo)
+	return ok && oa.Weight == a.Weight
+}
+
+// SetAddrInfo returns a copy of addr in which Attributes is updated with
+// addrInfo. addrInfo is retrieved from the address by GetAddrInfo.
+func SetAddrInfo(addr resolver.Address, addrInfo AddrInfo) resolver.Address {
+	addr.Attributes = addr.Attributes.WithValue(attributeKey{}, addrInfo)
+	return addr
+}
+
+// GetAddrInfo returns the AddrInfo stored in addr, and whether it was
+// present.
+func GetAddrInfo(addr resolver.Address) (AddrInfo, bool) {
+	ai, ok := addr.Attributes.Value(attributeKey{}).(AddrInfo)
+	return ai, ok
+}
+
+// scWeight pairs a READY SubConn with the weight carried by its address, plus
+// the running "current" value used by the EDF schedule below.
+type scWeight struct {
+	sc      balancer.SubConn
+	weight  uint32
+	current int64
+}
+
+type pickerBuilder struct{}
+
+func (*pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	scs := make([]*scWeight, 0, len(info.ReadySCs))
+	var anyWeighted bool
+	for sc, scInfo := range info.ReadySCs {
+		weight := uint32(1)
+		if ai, ok := GetAddrInfo(scInfo.Address); ok {
+			// An explicit weight of 0 must be preserved (and excluded from
+			// the schedule by wrrPicker.Pick below), not treated as "no
+			// weight set". anyWeighted tracks whether any SubConn carries
+			// the attribute at all, so a zero weight mixed with unweighted
+			// SubConns still triggers the weighted path instead of falling
+			// back to plain round-robin.
+			weight = ai.Weight
+			anyWeighted = true
+		}
+		scs = append(scs, &scWeight{sc: sc, weight: weight})
+	}
+	if !anyWeighted {
+		// No address in this update carries a weight attribute: behave
+		// exactly like round_robin instead of treating every address as
+		// equally (and arbitrarily) weighted.
+		rrSCs := make([]balancer.SubConn, len(scs))
+		for i, sw := range scs {
+			rrSCs[i] = sw.sc
+		}
+		return &rrPicker{subConns: rrSCs}
+	}
+	return newWRRPicker(scs)
+}
+
+// rrPicker is a plain round-robin picker, used when no address in the most
+// recent update carries a weight attribute.
+type rrPicker struct {
+	mu       sync.Mutex
+	next     int
+	subConns []balancer.SubConn
+}
+
+func (p *rrPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	p.mu.Lock()
+	sc := p.subConns[p.next]
+	p.next = (p.next + 1) % len(p.subConns)
+	p.mu.Unlock()
+	return balancer.PickResult{SubConn: sc}, nil
+}
+
+// wrrPicker implements a smooth weighted round-robin schedule (the same
+// algorithm used by nginx and LVS): every pick advances each backend's
+// "current" value by its weight, then selects the backend with the largest
+// current value and debits it by the total weight. This interleaves picks
+// proportionally to weight instead of bursting all picks for one backend
+// together before moving to the next.
+type wrrPicker struct {
+	mu    sync.Mutex
+	scs   []*scWeight
+	total int64
+}
+
+func newWRRPicker(scs []*scWeight) *wrrPicker {
+	p := &wrrPicker{scs: scs}
+	for _, sw := range scs {
+		p.total += int64(sw.weight)
+	}
+	return p
+}
+
+func (p *wrrPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best *scWeight
+	for _, sw := range p.scs {
+		if sw.weight == 0 {
+			// Zero-weight addresses are excluded from the schedule entirely.
+			continue
+		}
+		sw.current += int64(sw.weight)
+		if best == nil || sw.current > best.current {
+			best = sw
+		}
+	}
+	best.current -= p.total
+	return balancer.PickResult{SubConn: best.sc}, nil
+}
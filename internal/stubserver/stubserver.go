@@ -0,0 +1,121 @@
+/*
+ *
+ * Copyright 2020 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package stubserver is used to test grpc behaviors by implementing a
+// TestServiceServer whose method bodies can be set inline, rather than
+// needing to write a new implementation type for every test case.
+package stubserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/tap"
+	testgrpc "google.golang.org/grpc/test/grpc_testing"
+	testpb "google.golang.org/grpc/test/grpc_testing"
+)
+
+// StubServer is a server that is easy to customize within individual test
+// cases, for testing various gRPC behaviors. Method bodies left as nil
+// return a plain (non-status) error, which the client sees as codes.Unknown.
+type StubServer struct {
+	// Guarantees we satisfy this interface; panics if unimplemented methods
+	// are called.
+	testgrpc.TestServiceServer
+
+	// Customizable implementations of server handlers.
+	EmptyCallF      func(ctx context.Context, in *testpb.Empty) (*testpb.Empty, error)
+	UnaryCallF      func(ctx context.Context, in *testpb.SimpleRequest) (*testpb.SimpleResponse, error)
+	FullDuplexCallF func(stream testgrpc.TestService_FullDuplexCallServer) error
+
+	// OnServerCreated, if non-nil, is called with the grpc.Server after it
+	// is created and the TestService has been registered on it, but before
+	// it starts serving. This is the hook for tests that need to register
+	// additional services (e.g. the health service) on the same server.
+	OnServerCreated func(*grpc.Server)
+
+	// TapHandle, if non-nil, is installed as the server's InTapHandle via
+	// grpc.InTapHandle when StartServer is called, letting tests inspect or
+	// reject RPCs before the method handler runs (e.g. to simulate load
+	// shedding).
+	TapHandle tap.ServerInHandle
+
+	// Address is the local address the server listens on. Set in
+	// StartServer.
+	Address string
+
+	// S and Lis are the underlying server and listener created by
+	// StartServer.
+	S   *grpc.Server
+	Lis net.Listener
+}
+
+func (ss *StubServer) EmptyCall(ctx context.Context, in *testpb.Empty) (*testpb.Empty, error) {
+	if ss.EmptyCallF == nil {
+		return nil, fmt.Errorf("EmptyCall unimplemented")
+	}
+	return ss.EmptyCallF(ctx, in)
+}
+
+func (ss *StubServer) UnaryCall(ctx context.Context, in *testpb.SimpleRequest) (*testpb.SimpleResponse, error) {
+	if ss.UnaryCallF == nil {
+		return nil, fmt.Errorf("UnaryCall unimplemented")
+	}
+	return ss.UnaryCallF(ctx, in)
+}
+
+func (ss *StubServer) FullDuplexCall(stream testgrpc.TestService_FullDuplexCallServer) error {
+	if ss.FullDuplexCallF == nil {
+		return fmt.Errorf("FullDuplexCall unimplemented")
+	}
+	return ss.FullDuplexCallF(stream)
+}
+
+// StartServer starts the server on an arbitrary local address and makes it
+// ready to handle RPCs. Callers must call Stop when done.
+func (ss *StubServer) StartServer(sopts ...grpc.ServerOption) error {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return fmt.Errorf("net.Listen(tcp, localhost:0) failed: %v", err)
+	}
+	ss.Address = lis.Addr().String()
+	ss.Lis = lis
+
+	if ss.TapHandle != nil {
+		sopts = append(sopts, grpc.InTapHandle(ss.TapHandle))
+	}
+
+	s := grpc.NewServer(sopts...)
+	testgrpc.RegisterTestServiceServer(s, ss)
+	if ss.OnServerCreated != nil {
+		ss.OnServerCreated(s)
+	}
+	ss.S = s
+
+	go s.Serve(lis)
+	return nil
+}
+
+// Stop stops the server and closes its listener.
+func (ss *StubServer) Stop() {
+	if ss.S != nil {
+		ss.S.Stop()
+	}
+}
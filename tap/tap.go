@@ -0,0 +1,51 @@
+/*
+ *
+ * Copyright 2018 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package tap defines the function handles which are executed on the
+// transport layer before a request is handed over to the method handler,
+// allowing for pre-handler admission control such as load shedding.
+package tap
+
+import (
+	"context"
+)
+
+// Info defines the relevant information needed by the handles.
+type Info struct {
+	// FullMethodName is the string of the full RPC method, in the format of
+	// /package.service/method.
+	FullMethodName string
+
+	// TODO: More to be added.
+}
+
+// ServerInHandle defines the function which runs before a request is handed
+// over to the method handler. The Info parameter carries the information
+// about the RPC being intercepted. The context used by the rest of the
+// handler chain is the context returned by this handle, or the original
+// context if this handle returns a nil context. If a non-nil error is
+// returned, it terminates the RPC and the error is returned to the client as
+// the RPC status, without invoking the method handler; this is how a tap
+// handle rejects an RPC (e.g. with codes.ResourceExhausted for load
+// shedding).
+//
+// ServerInHandle must not block and should return in a short period of
+// time. A long-running handle delays all RPCs on the connection, because
+// gRPC pre-processes an RPC before reading the rest of the RPC request from
+// the wire.
+type ServerInHandle func(ctx context.Context, info *Info) (context.Context, error)
@@ -21,14 +21,20 @@ package test
 import (
 	"context"
 	"fmt"
+	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer/weightedroundrobin"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/internal/grpcsync"
 	imetadata "google.golang.org/grpc/internal/metadata"
 	"google.golang.org/grpc/internal/stubserver"
@@ -38,11 +44,17 @@ import (
 	"google.golang.org/grpc/resolver/manual"
 	"google.golang.org/grpc/stats"
 	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/tap"
 	testgrpc "google.golang.org/grpc/test/grpc_testing"
 	testpb "google.golang.org/grpc/test/grpc_testing"
 )
 
 const rrServiceConfig = `{"loadBalancingConfig": [{"round_robin":{}}]}`
+const wrrServiceConfig = `{"loadBalancingConfig": [{"weighted_round_robin":{}}]}`
+const rrHealthCheckServiceConfig = `{
+	"loadBalancingConfig": [{"round_robin":{}}],
+	"healthCheckConfig": {"serviceName": "foo"}
+}`
 
 func statsHandlerDialOption(funcs statsHandlerFuncs) grpc.DialOption {
 	return grpc.WithStatsHandler(&statsHandler{funcs: funcs})
@@ -409,3 +421,478 @@ Done:
 		time.Sleep(defaultTestShortTimeout)
 	}
 }
+
+// checkWeightedRoundRobin waits for connections to all addrs with a non-zero
+// weight to be up, sends 3*sum(weights) RPCs, and verifies that each address
+// receives at least half of its weighted share of them (weights[i]
+// corresponds to addrs[i]). A weight of 0 means the address must never be
+// picked.
+func checkWeightedRoundRobin(ctx context.Context, client testgrpc.TestServiceClient, addrs []resolver.Address, weights []uint32) error {
+	var peer peer.Peer
+	for i := 0; i < len(addrs); i++ {
+		if weights[i] == 0 {
+			continue
+		}
+		for {
+			time.Sleep(time.Millisecond)
+			if ctx.Err() != nil {
+				return fmt.Errorf("timeout waiting for connection to %q to be up", addrs[i].Addr)
+			}
+			if _, err := client.EmptyCall(ctx, &testpb.Empty{}, grpc.Peer(&peer)); err != nil {
+				continue
+			}
+			if peer.Addr.String() == addrs[i].Addr {
+				break
+			}
+		}
+	}
+
+	var total uint32
+	for _, w := range weights {
+		total += w
+	}
+	const iterations = 3
+	counts := make(map[string]int)
+	for i := 0; i < int(total)*iterations; i++ {
+		if _, err := client.EmptyCall(ctx, &testpb.Empty{}, grpc.Peer(&peer)); err != nil {
+			return fmt.Errorf("EmptyCall() = %v, want <nil>", err)
+		}
+		counts[peer.Addr.String()]++
+	}
+
+	for i, addr := range addrs {
+		got := counts[addr.Addr]
+		if weights[i] == 0 {
+			if got != 0 {
+				return fmt.Errorf("zero-weight addr %q received %d RPCs, want 0", addr.Addr, got)
+			}
+			continue
+		}
+		want := int(weights[i]) * iterations
+		// Allow some slack for scheduling: the address must receive at
+		// least half of its weighted share. No upper bound is checked.
+		if got < want/2 {
+			return fmt.Errorf("addr %q received %d RPCs, want at least %d (weight %d)", addr.Addr, got, want/2, weights[i])
+		}
+	}
+	return nil
+}
+
+// setupWeightedRoundRobinBackends starts a backend per entry in weights, and
+// returns a manual resolver, the backends, and the resolver.Addresses (with
+// the weighted_round_robin weight attribute already attached) used to reach
+// them. The caller is responsible for pushing the returned addresses (or a
+// modified copy of them) to the resolver.
+func setupWeightedRoundRobinBackends(t *testing.T, weights []uint32) (*manual.Resolver, []*stubserver.StubServer, []resolver.Address) {
+	t.Helper()
+	r := manual.NewBuilderWithScheme("whatever")
+
+	backends := make([]*stubserver.StubServer, len(weights))
+	addrs := make([]resolver.Address, len(weights))
+	for i := range weights {
+		backend := &stubserver.StubServer{
+			EmptyCallF: func(ctx context.Context, in *testpb.Empty) (*testpb.Empty, error) { return &testpb.Empty{}, nil },
+		}
+		if err := backend.StartServer(); err != nil {
+			t.Fatalf("Failed to start backend: %v", err)
+		}
+		t.Logf("Started TestService backend at: %q", backend.Address)
+		t.Cleanup(func() { backend.Stop() })
+
+		backends[i] = backend
+		addrs[i] = weightedroundrobin.SetAddrInfo(resolver.Address{Addr: backend.Address}, weightedroundrobin.AddrInfo{Weight: weights[i]})
+	}
+	return r, backends, addrs
+}
+
+// TestWeightedRoundRobin_Basic verifies that RPCs are distributed across a
+// set of backends proportionally to the weight attribute set on each
+// backend's resolver.Address.
+func (s) TestWeightedRoundRobin_Basic(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	weights := []uint32{1, 2, 3}
+	r, _, addrs := setupWeightedRoundRobinBackends(t, weights)
+
+	cc, err := grpc.Dial(r.Scheme()+":///test.server",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithResolvers(r),
+		grpc.WithDefaultServiceConfig(wrrServiceConfig))
+	if err != nil {
+		t.Fatalf("grpc.Dial() failed: %v", err)
+	}
+	t.Cleanup(func() { cc.Close() })
+
+	r.UpdateState(resolver.State{Addresses: addrs})
+	client := testgrpc.NewTestServiceClient(cc)
+	if err := checkWeightedRoundRobin(ctx, client, addrs, weights); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWeightedRoundRobin_UpdatedWeights verifies that a resolver update
+// carrying new weights for the same set of addresses changes the
+// distribution of RPCs across them accordingly.
+func (s) TestWeightedRoundRobin_UpdatedWeights(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	r, backends, addrs := setupWeightedRoundRobinBackends(t, []uint32{1, 1})
+
+	cc, err := grpc.Dial(r.Scheme()+":///test.server",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithResolvers(r),
+		grpc.WithDefaultServiceConfig(wrrServiceConfig))
+	if err != nil {
+		t.Fatalf("grpc.Dial() failed: %v", err)
+	}
+	t.Cleanup(func() { cc.Close() })
+
+	r.UpdateState(resolver.State{Addresses: addrs})
+	client := testgrpc.NewTestServiceClient(cc)
+	if err := checkWeightedRoundRobin(ctx, client, addrs, []uint32{1, 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Push a new resolver state where the second backend carries a much
+	// higher weight than the first, and verify the distribution shifts.
+	newWeights := []uint32{1, 9}
+	newAddrs := make([]resolver.Address, len(addrs))
+	for i, w := range newWeights {
+		newAddrs[i] = weightedroundrobin.SetAddrInfo(resolver.Address{Addr: backends[i].Address}, weightedroundrobin.AddrInfo{Weight: w})
+	}
+	r.UpdateState(resolver.State{Addresses: newAddrs})
+	if err := checkWeightedRoundRobin(ctx, client, newAddrs, newWeights); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWeightedRoundRobin_ZeroWeight verifies that an address with an
+// explicit weight of 0 is excluded from the picker entirely.
+func (s) TestWeightedRoundRobin_ZeroWeight(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	weights := []uint32{1, 0, 1}
+	r, _, addrs := setupWeightedRoundRobinBackends(t, weights)
+
+	cc, err := grpc.Dial(r.Scheme()+":///test.server",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithResolvers(r),
+		grpc.WithDefaultServiceConfig(wrrServiceConfig))
+	if err != nil {
+		t.Fatalf("grpc.Dial() failed: %v", err)
+	}
+	t.Cleanup(func() { cc.Close() })
+
+	r.UpdateState(resolver.State{Addresses: addrs})
+	client := testgrpc.NewTestServiceClient(cc)
+	if err := checkWeightedRoundRobin(ctx, client, addrs, weights); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWeightedRoundRobin_ZeroWeightMixedWithUnweighted verifies that an
+// address with an explicit weight of 0 is still excluded from the picker
+// even when mixed with addresses that carry no weight attribute at all
+// (implicit weight 1), rather than only when every address is explicitly
+// weighted.
+func (s) TestWeightedRoundRobin_ZeroWeightMixedWithUnweighted(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	r := manual.NewBuilderWithScheme("whatever")
+	const backendCount = 3
+	backends := make([]*stubserver.StubServer, backendCount)
+	addrs := make([]resolver.Address, backendCount)
+	for i := 0; i < backendCount; i++ {
+		backend := &stubserver.StubServer{
+			EmptyCallF: func(ctx context.Context, in *testpb.Empty) (*testpb.Empty, error) { return &testpb.Empty{}, nil },
+		}
+		if err := backend.StartServer(); err != nil {
+			t.Fatalf("Failed to start backend: %v", err)
+		}
+		t.Cleanup(func() { backend.Stop() })
+		backends[i] = backend
+
+		addr := resolver.Address{Addr: backend.Address}
+		if i == 1 {
+			// Only this address carries an explicit (zero) weight
+			// attribute; the other two carry none at all.
+			addr = weightedroundrobin.SetAddrInfo(addr, weightedroundrobin.AddrInfo{Weight: 0})
+		}
+		addrs[i] = addr
+	}
+
+	cc, err := grpc.Dial(r.Scheme()+":///test.server",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithResolvers(r),
+		grpc.WithDefaultServiceConfig(wrrServiceConfig))
+	if err != nil {
+		t.Fatalf("grpc.Dial() failed: %v", err)
+	}
+	t.Cleanup(func() { cc.Close() })
+
+	r.UpdateState(resolver.State{Addresses: addrs})
+	client := testgrpc.NewTestServiceClient(cc)
+	if err := checkWeightedRoundRobin(ctx, client, addrs, []uint32{1, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWeightedRoundRobin_FallbackToRoundRobin verifies that when no address
+// in a resolver update carries a weight attribute, weighted_round_robin
+// behaves exactly like plain round_robin.
+func (s) TestWeightedRoundRobin_FallbackToRoundRobin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	r := manual.NewBuilderWithScheme("whatever")
+	const backendCount = 3
+	addrs := make([]resolver.Address, backendCount)
+	for i := 0; i < backendCount; i++ {
+		backend := &stubserver.StubServer{
+			EmptyCallF: func(ctx context.Context, in *testpb.Empty) (*testpb.Empty, error) { return &testpb.Empty{}, nil },
+		}
+		if err := backend.StartServer(); err != nil {
+			t.Fatalf("Failed to start backend: %v", err)
+		}
+		t.Cleanup(func() { backend.Stop() })
+		addrs[i] = resolver.Address{Addr: backend.Address}
+	}
+
+	cc, err := grpc.Dial(r.Scheme()+":///test.server",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithResolvers(r),
+		grpc.WithDefaultServiceConfig(wrrServiceConfig))
+	if err != nil {
+		t.Fatalf("grpc.Dial() failed: %v", err)
+	}
+	t.Cleanup(func() { cc.Close() })
+
+	r.UpdateState(resolver.State{Addresses: addrs})
+	client := testgrpc.NewTestServiceClient(cc)
+	if err := checkRoundRobin(ctx, client, addrs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRoundRobin_HealthCheck tests that, when the service config enables
+// healthCheckConfig.serviceName, round_robin excludes a backend from its
+// picker while its health server reports NOT_SERVING for that service, and
+// brings it back once the health server reports SERVING again, all without
+// the underlying connection to that backend ever going down.
+func (s) TestRoundRobin_HealthCheck(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	// dialCounts tracks, per backend address, how many times the channel has
+	// dialed a new TCP connection to it. A health transition must not cause
+	// a redial: the SubConn is expected to stay connected and simply drop in
+	// and out of the picker's rotation.
+	var mu sync.Mutex
+	dialCounts := make(map[string]int)
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialCounts[addr]++
+		mu.Unlock()
+		return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	dialCountFor := func(addr string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return dialCounts[addr]
+	}
+
+	r := manual.NewBuilderWithScheme("whatever")
+	const backendCount = 3
+	backends := make([]*stubserver.StubServer, backendCount)
+	healthServers := make([]*health.Server, backendCount)
+	addrs := make([]resolver.Address, backendCount)
+	for i := 0; i < backendCount; i++ {
+		hs := health.NewServer()
+		hs.SetServingStatus("foo", healthpb.HealthCheckResponse_SERVING)
+		healthServers[i] = hs
+
+		backend := &stubserver.StubServer{
+			EmptyCallF: func(ctx context.Context, in *testpb.Empty) (*testpb.Empty, error) { return &testpb.Empty{}, nil },
+			OnServerCreated: func(s *grpc.Server) {
+				healthpb.RegisterHealthServer(s, hs)
+			},
+		}
+		if err := backend.StartServer(); err != nil {
+			t.Fatalf("Failed to start backend: %v", err)
+		}
+		t.Cleanup(func() { backend.Stop() })
+
+		backends[i] = backend
+		addrs[i] = resolver.Address{Addr: backend.Address}
+	}
+
+	cc, err := grpc.Dial(r.Scheme()+":///test.server",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithResolvers(r),
+		grpc.WithContextDialer(dialer),
+		grpc.WithDefaultServiceConfig(rrHealthCheckServiceConfig))
+	if err != nil {
+		t.Fatalf("grpc.Dial() failed: %v", err)
+	}
+	t.Cleanup(func() { cc.Close() })
+
+	r.UpdateState(resolver.State{Addresses: addrs})
+	client := testgrpc.NewTestServiceClient(cc)
+	if err := checkRoundRobin(ctx, client, addrs); err != nil {
+		t.Fatal(err)
+	}
+
+	toggledAddr := addrs[backendCount-1].Addr
+	dialsBeforeToggle := dialCountFor(toggledAddr)
+	if dialsBeforeToggle == 0 {
+		t.Fatalf("no connection was ever dialed to %q", toggledAddr)
+	}
+
+	// Mark the last backend as NOT_SERVING. round_robin must shrink its set
+	// to the remaining backends without the connection to it dropping.
+	healthServers[backendCount-1].SetServingStatus("foo", healthpb.HealthCheckResponse_NOT_SERVING)
+	if err := checkRoundRobin(ctx, client, addrs[:backendCount-1]); err != nil {
+		t.Fatalf("RPCs are not being round robined across the serving backends: %v", err)
+	}
+	if got := dialCountFor(toggledAddr); got != dialsBeforeToggle {
+		t.Fatalf("connection to %q was redialed (count %d -> %d) when it went NOT_SERVING, want the same TCP connection kept open", toggledAddr, dialsBeforeToggle, got)
+	}
+
+	// Flip it back to SERVING; it should rejoin the picker's rotation.
+	healthServers[backendCount-1].SetServingStatus("foo", healthpb.HealthCheckResponse_SERVING)
+	if err := checkRoundRobin(ctx, client, addrs); err != nil {
+		t.Fatalf("backend did not rejoin round robin set after becoming SERVING again: %v", err)
+	}
+	if got := dialCountFor(toggledAddr); got != dialsBeforeToggle {
+		t.Fatalf("connection to %q was redialed (count %d -> %d) when it went back to SERVING, want the same TCP connection kept open", toggledAddr, dialsBeforeToggle, got)
+	}
+}
+
+// TestRoundRobin_TapLoadShedding tests a backend that uses a tap handle to
+// shed the first few RPCs it receives with codes.ResourceExhausted, as an
+// admission-control backend would. It verifies that round_robin continues
+// sending that backend its normal share of traffic (the tap rejection is not
+// mistaken for the backend being down), and that the client-side stats
+// handler observes the rejection as a normal RPC failure.
+func (s) TestRoundRobin_TapLoadShedding(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+
+	const (
+		backendCount = 3
+		shedCount    = 2
+	)
+
+	var tapped, served int32
+	shedderIdx := 0
+
+	r := manual.NewBuilderWithScheme("whatever")
+	backends := make([]*stubserver.StubServer, backendCount)
+	addrs := make([]resolver.Address, backendCount)
+	for i := 0; i < backendCount; i++ {
+		backend := &stubserver.StubServer{
+			EmptyCallF: func(ctx context.Context, in *testpb.Empty) (*testpb.Empty, error) {
+				atomic.AddInt32(&served, 1)
+				return &testpb.Empty{}, nil
+			},
+		}
+		if i == shedderIdx {
+			backend.TapHandle = func(ctx context.Context, _ *tap.Info) (context.Context, error) {
+				if atomic.AddInt32(&tapped, 1) <= shedCount {
+					return ctx, status.Error(codes.ResourceExhausted, "load shedding")
+				}
+				return ctx, nil
+			}
+		}
+		if err := backend.StartServer(); err != nil {
+			t.Fatalf("Failed to start backend: %v", err)
+		}
+		t.Cleanup(func() { backend.Stop() })
+		backends[i] = backend
+		addrs[i] = resolver.Address{Addr: backend.Address}
+	}
+
+	// rejectedByStatsHandler records how many RPCs the client-side stats
+	// handler saw end with ResourceExhausted. Only the shedder's tap rejects
+	// RPCs, so every such RPC is counted under the shedder's address. The tap
+	// handle runs on the server before the method handler, so this confirms
+	// the stats handler's End callback -- which fires after the RPC returns
+	// to the client -- reflects the tap rejection rather than a connection
+	// failure.
+	rejectedByStatsHandler := make(map[string]int)
+	var mu sync.Mutex
+	shOption := statsHandlerDialOption(statsHandlerFuncs{
+		HandleRPC: func(_ context.Context, rpcStats stats.RPCStats) {
+			end, ok := rpcStats.(*stats.End)
+			if !ok || end.Error == nil {
+				return
+			}
+			if status.Code(end.Error) != codes.ResourceExhausted {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			rejectedByStatsHandler[addrs[shedderIdx].Addr]++
+		},
+	})
+
+	cc, err := grpc.Dial(r.Scheme()+":///test.server",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithResolvers(r),
+		grpc.WithDefaultServiceConfig(rrServiceConfig),
+		shOption)
+	if err != nil {
+		t.Fatalf("grpc.Dial() failed: %v", err)
+	}
+	t.Cleanup(func() { cc.Close() })
+
+	r.UpdateState(resolver.State{Addresses: addrs})
+	client := testgrpc.NewTestServiceClient(cc)
+
+	// Wait for connections to all backends to be up before counting RPCs,
+	// the same way checkRoundRobin does, so that RPCs which fail fast while
+	// the channel is still connecting aren't mistaken for tap rejections or
+	// left out of the served/tapped counts below.
+	var warmupPeer peer.Peer
+	for i := 0; i < backendCount; i++ {
+		for {
+			time.Sleep(time.Millisecond)
+			if ctx.Err() != nil {
+				t.Fatalf("timeout waiting for connection to %q to be up", addrs[i].Addr)
+			}
+			if _, err := client.EmptyCall(ctx, &testpb.Empty{}, grpc.Peer(&warmupPeer)); err != nil {
+				continue
+			}
+			if warmupPeer.Addr.String() == addrs[i].Addr {
+				break
+			}
+		}
+	}
+
+	// Drive enough RPCs that every backend, including the shedder, is hit
+	// several times after the shedding window closes.
+	const rounds = 3 * backendCount
+	for i := 0; i < rounds+shedCount; i++ {
+		client.EmptyCall(ctx, &testpb.Empty{})
+	}
+
+	if got := int(atomic.LoadInt32(&tapped)); got < shedCount {
+		t.Fatalf("shedder backend's tap handle ran %d times, want at least %d", got, shedCount)
+	}
+	if got := rejectedByStatsHandler[addrs[shedderIdx].Addr]; got < shedCount {
+		t.Fatalf("stats handler observed %d ResourceExhausted RPCs to the shedder, want at least %d", got, shedCount)
+	}
+	if got := int(atomic.LoadInt32(&served)); got < rounds {
+		t.Fatalf("backends served %d RPCs, want at least %d", got, rounds)
+	}
+	// The shedder must still be counted as connected and kept in the
+	// round_robin rotation: once past the shedding window, RPCs are
+	// round-robined across all three backends exactly like before.
+	if err := checkRoundRobin(ctx, client, addrs); err != nil {
+		t.Fatalf("shedder backend was ejected from round_robin instead of staying in rotation: %v", err)
+	}
+}